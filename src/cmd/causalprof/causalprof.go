@@ -3,8 +3,11 @@ package main
 
 import (
 	"bufio"
+	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"sort"
 	"strconv"
@@ -13,50 +16,165 @@ import (
 	"cmd/internal/objfile"
 )
 
+var export = flag.String("export", "", "write a JSON series file for the causal-profile plot viewer to this path, instead of printing a text report")
+var minSamples = flag.Int("min-samples", 20, "minimum number of experiment records, across all speedups combined, required to report a callsite or progress point")
+var ciFilter = flag.Bool("ci", true, "suppress latency results whose 95% confidence interval overlaps the null experiment's (not statistically significant)")
+
 func main() {
 	flag.Parse()
 	args := flag.Args()
 
-	if len(args) != 2 {
+	if len(args) < 1 || len(args) > 2 {
 		usage()
 	}
-	samples, err := readProfFile(args[0])
+	latency, throughput, err := readProfFile(args[0])
 	if err != nil {
 		fatalln(err.Error())
 	}
-	// get a symbol table to turn addresses into file:line
-	obj, err := objfile.Open(args[1])
-	if err != nil {
-		fatalln(err.Error())
+
+	// The new wire format resolves function/file/line at write time; the
+	// legacy text format only recorded a bare pc, so those samples still
+	// need resolving against the profiled binary's symbol table.
+	if needsSymbols(latency) {
+		if len(args) != 2 {
+			usage()
+		}
+		obj, err := objfile.Open(args[1])
+		if err != nil {
+			fatalln(err.Error())
+		}
+		pcln, err := obj.PCLineTable()
+		if err != nil {
+			fatalln(err.Error())
+		}
+		resolveSymbols(latency, pcln)
 	}
-	pcln, err := obj.PCLineTable()
-	if err != nil {
-		fatalln(err.Error())
+
+	if *export != "" {
+		if err := exportPlot(*export, latency, throughput); err != nil {
+			fatalln(err.Error())
+		}
+		return
 	}
+	reportLatency(latency)
+	reportThroughput(throughput)
+}
 
-	// make an index of experiments concerning the same callsite
-	index := make(map[uint64][]*sample)
+func needsSymbols(samples []*latencySample) bool {
 	for _, s := range samples {
-		i := index[s.pc]
-		i = append(i, s)
-		index[s.pc] = i
+		if s.function == "" {
+			return true
+		}
 	}
-	// throw away any callsite with an insufficient sample count
-	for pc, i := range index {
-		if len(i) < 20 {
-			delete(index, pc)
+	return false
+}
+
+func resolveSymbols(samples []*latencySample, pcln objfile.Liner) {
+	for _, s := range samples {
+		if s.function != "" {
+			continue
+		}
+		file, line, fn := pcln.PCToLine(s.pc - 1)
+		s.file = file
+		s.line = int64(line)
+		if fn != nil {
+			s.function = fn.Name
 		}
 	}
+}
+
+// reportLatency groups latency samples by callsite and prints, for each
+// callsite, the ns/op observed at each speedup tried relative to the null
+// (0% speedup) experiment.
+func reportLatency(samples []*latencySample) {
+	index, locs := indexLatency(samples)
 	if len(index) == 0 {
-		fmt.Println("not enough data")
+		fmt.Println("not enough latency data")
+		return
+	}
+	nullexp := extractNull(index)
+	if nullexp.merged == 0 {
+		fmt.Println("no null (0% speedup) experiment found; cannot report relative speedups")
+		return
+	}
+	for key, i := range index {
+		loc := locs[key]
+		if loc.function == "" {
+			fmt.Printf("%#x\n", loc.pc)
+		} else {
+			fmt.Printf("%s %s:%d\n", loc.function, loc.file, loc.line)
+		}
+		fmt.Printf("%3d%%\t%s\n", nullexp.speedup, nullexp.nsPerOpString())
+		for _, s := range i {
+			if s.speedup == 0 {
+				panic("unexpected")
+			}
+			if *ciFilter && !significant(nullexp, s) {
+				continue
+			}
+			percent := float64(s.nsPerOp()-nullexp.nsPerOp()) / float64(nullexp.nsPerOp())
+			percent *= 100
+			percentsamples := (float64(s.speedup)) * (float64(s.samples) / float64(s.allsamples))
+			fmt.Printf("%3d%%\t%s\t%+.3g%%\t%.3g%%\n", s.speedup, s.nsPerOpString(), percent, percentsamples)
+		}
+		fmt.Println()
+	}
+}
+
+// significant reports whether a and b's 95% confidence intervals do not
+// overlap, meaning the difference between their ns/op means is statistically
+// significant. It treats samples with too few trials to have a meaningful CI
+// (fewer than two) as always significant, so older profiles and text-format
+// input, which carry no CI data, are reported as before.
+func significant(a, b *latencySample) bool {
+	if a.trialSamples < 2 || b.trialSamples < 2 {
+		return true
+	}
+	alo, ahi := a.nsPerOp()-a.ciHalfWidthNs, a.nsPerOp()+a.ciHalfWidthNs
+	blo, bhi := b.nsPerOp()-b.ciHalfWidthNs, b.nsPerOp()+b.ciHalfWidthNs
+	return bhi < alo || blo > ahi
+}
+
+// latencyKey identifies a callsite. Experiments run under LineGranularity or
+// FunctionGranularity can report different pcs for the same site across
+// trials (the runtime picks whichever sampled pc triggered the experiment),
+// so callsites are keyed by resolved file:line rather than by pc; pc is kept
+// only as a fallback for samples that never resolved (no file). Records do
+// not say which granularity produced them, so FunctionGranularity records
+// reported from different lines of one function are separate callsites here.
+type latencyKey struct {
+	file string
+	line int64
+	pc   uint64
+}
+
+func latencyKeyOf(s *latencySample) latencyKey {
+	if s.file == "" {
+		return latencyKey{pc: s.pc}
+	}
+	return latencyKey{file: s.file, line: s.line}
+}
+
+// indexLatency groups samples by callsite, discards callsites with an
+// insufficient sample count, sorts and merges duplicate (callsite, speedup)
+// samples, and returns a location (for reporting) alongside the index.
+func indexLatency(samples []*latencySample) (map[latencyKey][]*latencySample, map[latencyKey]*latencySample) {
+	index := make(map[latencyKey][]*latencySample)
+	for _, s := range samples {
+		key := latencyKeyOf(s)
+		index[key] = append(index[key], s)
+	}
+	for key, i := range index {
+		if len(i) < *minSamples {
+			delete(index, key)
+		}
 	}
-	// sort each callsite by slowdown
 	for _, i := range index {
 		sort.Sort(bySpeedup(i))
 	}
-	// merge each duplicate (callsite, slowdown)
-	for pc, i := range index {
-		merged := []*sample{i[0]}
+	locs := make(map[latencyKey]*latencySample, len(index))
+	for key, i := range index {
+		merged := []*latencySample{i[0]}
 		for _, s := range i[1:] {
 			last := merged[len(merged)-1]
 			if last.speedup == s.speedup {
@@ -65,117 +183,438 @@ func main() {
 				merged = append(merged, s)
 			}
 		}
-		index[pc] = merged
+		index[key] = merged
+		locs[key] = merged[0]
 	}
-	// accumulate a single authoritative null experiment
-	var nullexp sample
-	for pc, i := range index {
+	return index, locs
+}
+
+// extractNull removes the null (0% speedup) experiment from each callsite in
+// index and returns a single authoritative null experiment merged across all
+// of them.
+func extractNull(index map[latencyKey][]*latencySample) *latencySample {
+	var nullexp latencySample
+	for key, i := range index {
 		if i[0].speedup == 0 {
 			nullexp.merge(i[0])
-			index[pc] = i[1:]
+			index[key] = i[1:]
 		}
 	}
-	for pc, i := range index {
-		file, line, fn := pcln.PCToLine(pc - 1)
-		if fn == nil {
-			fmt.Printf("%#x\n", pc)
-		} else {
-			fmt.Printf("%#x %s:%d\n", pc, file, line)
-		}
-		fmt.Printf("%3d%%\t%dns\n", nullexp.speedup, nullexp.nsPerOp())
+	return &nullexp
+}
+
+// reportThroughput groups throughput samples by progress-point name and
+// prints, for each name, the events/sec observed at each speedup tried
+// relative to the null (0% speedup) experiment.
+func reportThroughput(samples []*throughputSample) {
+	index := indexThroughput(samples)
+	if len(index) == 0 {
+		fmt.Println("not enough throughput data")
+		return
+	}
+	nullexp := extractThroughputNull(index)
+	for name, i := range index {
+		fmt.Printf("progress %s\n", name)
+		fmt.Printf("%3d%%\t%.3gev/s\n", nullexp.speedup, nullexp.rate())
 		for _, s := range i {
 			if s.speedup == 0 {
 				panic("unexpected")
 			}
-			percent := float64(s.nsPerOp()-nullexp.nsPerOp()) / float64(nullexp.nsPerOp())
+			percent := (s.rate() - nullexp.rate()) / nullexp.rate()
 			percent *= 100
-			percentsamples := (float64(s.speedup)) * (float64(s.delaysamples) / float64(s.allsamples))
-			fmt.Printf("%3d%%\t%dns\t%+.3g%%\t%.3g%%\n", s.speedup, s.nsPerOp(), percent, percentsamples)
+			fmt.Printf("%3d%%\t%.3gev/s\t%+.3g%%\n", s.speedup, s.rate(), percent)
 		}
 		fmt.Println()
 	}
 }
 
-type sample struct {
-	pc           uint64
-	speedup      int
-	merged       int64
-	nsPerOpAgg   int64
-	delaysamples int64
-	allsamples   int64
+func indexThroughput(samples []*throughputSample) map[string][]*throughputSample {
+	index := make(map[string][]*throughputSample)
+	for _, s := range samples {
+		index[s.name] = append(index[s.name], s)
+	}
+	for name, i := range index {
+		if len(i) < *minSamples {
+			delete(index, name)
+		}
+	}
+	for _, i := range index {
+		sort.Sort(byThroughputSpeedup(i))
+	}
+	for name, i := range index {
+		merged := []*throughputSample{i[0]}
+		for _, s := range i[1:] {
+			last := merged[len(merged)-1]
+			if last.speedup == s.speedup {
+				last.merge(s)
+			} else {
+				merged = append(merged, s)
+			}
+		}
+		index[name] = merged
+	}
+	return index
+}
+
+func extractThroughputNull(index map[string][]*throughputSample) *throughputSample {
+	var nullexp throughputSample
+	for name, i := range index {
+		if i[0].speedup == 0 {
+			nullexp.merge(i[0])
+			index[name] = i[1:]
+		}
+	}
+	return &nullexp
+}
+
+// plotSeries is one line's worth of experiments, in the format expected by
+// the causal-profile plot viewer: one series per callsite (or progress
+// point), with one point per virtual speedup tried.
+type plotSeries struct {
+	Name   string      `json:"name"`
+	Points []plotPoint `json:"points"`
+}
+
+// plotPoint is a single (virtual speedup, program speedup) pair. Min and Max
+// bound the 95% confidence interval of the program speedup, when the
+// underlying sample has one (see latencySample.ciHalfWidthNs); otherwise
+// they equal Y.
+type plotPoint struct {
+	X   float64 `json:"x"`
+	Y   float64 `json:"y"`
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// exportPlot writes a JSON array of plotSeries, one per latency callsite and
+// one per throughput progress point, to path ("-" for stdout).
+func exportPlot(path string, latency []*latencySample, throughput []*throughputSample) error {
+	var series []plotSeries
+
+	index, locs := indexLatency(latency)
+	nullexp := extractNull(index)
+	if nullexp.merged == 0 && len(index) > 0 {
+		return fmt.Errorf("no null (0%% speedup) experiment found; cannot export relative speedups")
+	}
+	for key, i := range index {
+		loc := locs[key]
+		name := loc.function
+		if name == "" {
+			name = fmt.Sprintf("%#x", loc.pc)
+		} else {
+			name = fmt.Sprintf("%s (%s:%d)", name, loc.file, loc.line)
+		}
+		s := plotSeries{Name: name}
+		for _, e := range i {
+			y := float64(e.nsPerOp()-nullexp.nsPerOp()) / float64(nullexp.nsPerOp()) * 100
+			ymin, ymax := y, y
+			if e.trialSamples >= 2 {
+				ymin = float64(e.nsPerOp()-e.ciHalfWidthNs-nullexp.nsPerOp()) / float64(nullexp.nsPerOp()) * 100
+				ymax = float64(e.nsPerOp()+e.ciHalfWidthNs-nullexp.nsPerOp()) / float64(nullexp.nsPerOp()) * 100
+			}
+			s.Points = append(s.Points, plotPoint{X: float64(e.speedup), Y: y, Min: ymin, Max: ymax})
+		}
+		series = append(series, s)
+	}
+
+	tindex := indexThroughput(throughput)
+	tnull := extractThroughputNull(tindex)
+	for name, i := range tindex {
+		s := plotSeries{Name: name}
+		for _, e := range i {
+			y := (e.rate() - tnull.rate()) / tnull.rate() * 100
+			s.Points = append(s.Points, plotPoint{X: float64(e.speedup), Y: y, Min: y, Max: y})
+		}
+		series = append(series, s)
+	}
+
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(series)
+}
+
+type latencySample struct {
+	pc         uint64
+	function   string
+	file       string
+	line       int64
+	speedup    int
+	merged     int64
+	nsPerOpAgg int64
+	samples    int64
+	allsamples int64
+
+	// ciHalfWidthNs and trialSamples are the 95% confidence interval
+	// half-width of nsPerOp and the trial count it was computed from, as of
+	// the record with the largest trialSamples merged into s (the runtime
+	// accumulates these across trials itself; see runtime/causalprof's
+	// welford type, so later records supersede earlier ones rather than
+	// needing to be combined).
+	ciHalfWidthNs int64
+	trialSamples  int64
 }
 
-func (s *sample) merge(o *sample) {
-	// if s.pc != o.pc || s.speedup != o.speedup {
-	// 	panic("different pcs or speedups")
-	// }
+func (s *latencySample) merge(o *latencySample) {
 	s.nsPerOpAgg += o.nsPerOpAgg
 	s.merged += o.merged
-	s.delaysamples += o.delaysamples
+	s.samples += o.samples
 	s.allsamples += o.allsamples
+	if o.trialSamples > s.trialSamples {
+		s.ciHalfWidthNs = o.ciHalfWidthNs
+		s.trialSamples = o.trialSamples
+	}
 }
 
-func (s *sample) nsPerOp() int64 {
+func (s *latencySample) nsPerOp() int64 {
 	return s.nsPerOpAgg / s.merged
 }
 
-type bySpeedup []*sample
+// nsPerOpString formats nsPerOp with its confidence interval, when one is
+// available.
+func (s *latencySample) nsPerOpString() string {
+	if s.trialSamples < 2 {
+		return fmt.Sprintf("%dns", s.nsPerOp())
+	}
+	return fmt.Sprintf("%dns ± %dns", s.nsPerOp(), s.ciHalfWidthNs)
+}
+
+type bySpeedup []*latencySample
 
 func (b bySpeedup) Len() int           { return len(b) }
 func (b bySpeedup) Less(i, j int) bool { return b[i].speedup < b[j].speedup }
 func (b bySpeedup) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
 
-func readProfFile(path string) ([]*sample, error) {
+type throughputSample struct {
+	name       string
+	speedup    int
+	events     int64
+	elapsedns  int64
+	samples    int64
+	allsamples int64
+}
+
+func (s *throughputSample) merge(o *throughputSample) {
+	s.events += o.events
+	s.elapsedns += o.elapsedns
+	s.samples += o.samples
+	s.allsamples += o.allsamples
+}
+
+func (s *throughputSample) rate() float64 {
+	return float64(s.events) / (float64(s.elapsedns) / 1e9)
+}
+
+type byThroughputSpeedup []*throughputSample
+
+func (b byThroughputSpeedup) Len() int           { return len(b) }
+func (b byThroughputSpeedup) Less(i, j int) bool { return b[i].speedup < b[j].speedup }
+func (b byThroughputSpeedup) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+const profileMagic = "cprf"
+
+// readProfFile reads a causal profiling output file, returning the latency
+// and throughput samples it contains. It understands both the versioned
+// binary stream written by runtime/causalprof and the legacy line-oriented
+// text format it replaced.
+func readProfFile(path string) ([]*latencySample, []*throughputSample, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	defer f.Close()
 
-	var samples []*sample
-	scan := bufio.NewScanner(f)
-	for scan.Scan() {
-		s := scan.Text()
-		if len(s) < 1 || s[0] == '#' {
-			continue
-		}
-		fields := strings.Fields(s)
-		if len(fields) != 5 {
-			return nil, fmt.Errorf("corrupt causalprof file, had %d fields; expected 3", len(fields))
+	r := bufio.NewReader(f)
+	if magic, err := r.Peek(len(profileMagic)); err == nil && string(magic) == profileMagic {
+		return readProfStream(r)
+	}
+	return readProfText(r)
+}
+
+func readProfStream(r *bufio.Reader) ([]*latencySample, []*throughputSample, error) {
+	hdr := make([]byte, len(profileMagic)+1)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	if version := hdr[len(profileMagic)]; version != 1 {
+		return nil, nil, fmt.Errorf("unsupported causal profile version %d", version)
+	}
+
+	var latency []*latencySample
+	var throughput []*throughputSample
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
 		}
-		pc, err := strconv.ParseUint(fields[0], 0, 64)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		speedup, err := strconv.Atoi(fields[1])
-		if err != nil {
-			return nil, err
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, nil, err
 		}
-		nsPerOp, err := strconv.ParseInt(fields[2], 10, 64)
+		e, err := decodeExperiment(data)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		delaysamples, err := strconv.ParseInt(fields[3], 10, 64)
-		if err != nil {
-			return nil, err
+		switch e.kind {
+		case kindLatency:
+			latency = append(latency, &latencySample{
+				pc:            e.pc,
+				function:      e.function,
+				file:          e.file,
+				line:          e.line,
+				speedup:       int(e.speedupPercent),
+				merged:        1,
+				nsPerOpAgg:    e.nsPerOp,
+				samples:       int64(e.samples),
+				allsamples:    int64(e.allsamples),
+				ciHalfWidthNs: e.ciHalfWidthNs,
+				trialSamples:  e.trialSamples,
+			})
+		case kindThroughput:
+			throughput = append(throughput, &throughputSample{
+				name:       e.name,
+				speedup:    int(e.speedupPercent),
+				events:     e.events,
+				elapsedns:  e.elapsedNs,
+				samples:    int64(e.samples),
+				allsamples: int64(e.allsamples),
+			})
+		default:
+			return nil, nil, fmt.Errorf("unknown experiment kind %d", e.kind)
 		}
-		allsamples, err := strconv.ParseInt(fields[4], 10, 64)
-		if err != nil {
-			return nil, err
+	}
+	return latency, throughput, nil
+}
+
+func readProfText(r io.Reader) ([]*latencySample, []*throughputSample, error) {
+	var latency []*latencySample
+	var throughput []*throughputSample
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		s := scan.Text()
+		if len(s) < 1 || s[0] == '#' {
+			continue
+		}
+		var fields map[string]string
+		if f := strings.Fields(s); len(f) == 5 && !strings.Contains(s, "=") {
+			// Legacy positional record: pc speedup ns samples allsamples.
+			fields = map[string]string{"type": "latency", "pc": f[0], "speedup": f[1], "ns": f[2], "samples": f[3], "allsamples": f[4]}
+		} else {
+			var err error
+			fields, err = parseFields(s)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		switch fields["type"] {
+		case "latency":
+			sample, err := parseLatencySample(fields)
+			if err != nil {
+				return nil, nil, err
+			}
+			latency = append(latency, sample)
+		case "throughput":
+			sample, err := parseThroughputSample(fields)
+			if err != nil {
+				return nil, nil, err
+			}
+			throughput = append(throughput, sample)
+		default:
+			return nil, nil, fmt.Errorf("corrupt causalprof file, unknown record type %q", fields["type"])
+		}
+	}
+	return latency, throughput, scan.Err()
+}
+
+// parseFields splits a record line into its key=value fields.
+func parseFields(s string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, f := range strings.Fields(s) {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("corrupt causalprof file, malformed field %q", f)
 		}
-		samples = append(samples, &sample{
-			pc:           pc,
-			speedup:      speedup,
-			nsPerOpAgg:   nsPerOp,
-			merged:       1,
-			delaysamples: delaysamples,
-			allsamples:   allsamples,
-		})
+		fields[kv[0]] = kv[1]
+	}
+	return fields, nil
+}
+
+func parseLatencySample(fields map[string]string) (*latencySample, error) {
+	pc, err := strconv.ParseUint(fields["pc"], 0, 64)
+	if err != nil {
+		return nil, err
+	}
+	speedup, err := strconv.Atoi(fields["speedup"])
+	if err != nil {
+		return nil, err
+	}
+	nsPerOp, err := strconv.ParseInt(fields["ns"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := strconv.ParseInt(fields["samples"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	allsamples, err := strconv.ParseInt(fields["allsamples"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &latencySample{
+		pc:         pc,
+		speedup:    speedup,
+		nsPerOpAgg: nsPerOp,
+		merged:     1,
+		samples:    samples,
+		allsamples: allsamples,
+	}, nil
+}
+
+func parseThroughputSample(fields map[string]string) (*throughputSample, error) {
+	speedup, err := strconv.Atoi(fields["speedup"])
+	if err != nil {
+		return nil, err
+	}
+	events, err := strconv.ParseInt(fields["events"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	elapsedns, err := strconv.ParseInt(fields["elapsedns"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := strconv.ParseInt(fields["samples"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	allsamples, err := strconv.ParseInt(fields["allsamples"], 10, 64)
+	if err != nil {
+		return nil, err
 	}
-	return samples, scan.Err()
+	return &throughputSample{
+		name:       fields["name"],
+		speedup:    speedup,
+		events:     events,
+		elapsedns:  elapsedns,
+		samples:    samples,
+		allsamples: allsamples,
+	}, nil
 }
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "usage: causalprof file program")
+	fmt.Fprintln(os.Stderr, "usage: causalprof [-export file] proffile [program]")
+	flag.PrintDefaults()
 	os.Exit(1)
 }
 
@@ -0,0 +1,61 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"runtime/causalprof"
+)
+
+// TestReadProfStreamAndText checks that the binary stream reader and the text
+// reader, the two readers readProfFile chooses between by magic prefix, each
+// decode the same latency record.
+func TestReadProfStreamAndText(t *testing.T) {
+	e := &causalprof.Experiment{
+		Kind:           causalprof.KindLatency,
+		Pc:             0x1000,
+		SpeedupPercent: 10,
+		NsPerOp:        500,
+	}
+	data := e.Marshal()
+	var stream bytes.Buffer
+	stream.WriteString(profileMagic)
+	stream.WriteByte(1)
+	var hdr [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(hdr[:], uint64(len(data)))
+	stream.Write(hdr[:n])
+	stream.Write(data)
+
+	latency, _, err := readProfStream(bufio.NewReader(&stream))
+	if err != nil {
+		t.Fatalf("readProfStream: %v", err)
+	}
+	if len(latency) != 1 || latency[0].speedup != 10 {
+		t.Fatalf("readProfStream decoded %+v, want one sample with speedup 10", latency)
+	}
+
+	text := "type=latency pc=0x1000 speedup=10 ns=500 samples=1 allsamples=1\n"
+	latency, _, err = readProfText(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("readProfText: %v", err)
+	}
+	if len(latency) != 1 || latency[0].speedup != 10 {
+		t.Fatalf("readProfText decoded %+v, want one sample with speedup 10", latency)
+	}
+}
+
+func TestNeedsSymbols(t *testing.T) {
+	if needsSymbols([]*latencySample{{function: "resolved"}}) {
+		t.Error("needsSymbols true for a sample that already has a function name")
+	}
+	if !needsSymbols([]*latencySample{{function: "resolved"}, {pc: 0x1000}}) {
+		t.Error("needsSymbols false when a sample still needs resolving")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestSignificant(t *testing.T) {
+	// Fewer than two trials means no CI was computed, so the pair is always
+	// treated as significant to preserve pre-CI behavior.
+	a := &latencySample{nsPerOpAgg: 100, merged: 1, trialSamples: 1}
+	b := &latencySample{nsPerOpAgg: 200, merged: 1, trialSamples: 1}
+	if !significant(a, b) {
+		t.Error("significant(a, b) = false with trialSamples < 2, want true")
+	}
+
+	// Non-overlapping intervals are significant.
+	a = &latencySample{nsPerOpAgg: 100, merged: 1, trialSamples: 5, ciHalfWidthNs: 5}
+	b = &latencySample{nsPerOpAgg: 200, merged: 1, trialSamples: 5, ciHalfWidthNs: 5}
+	if !significant(a, b) {
+		t.Error("significant(a, b) = false for non-overlapping CIs, want true")
+	}
+
+	// Overlapping intervals are not.
+	a = &latencySample{nsPerOpAgg: 100, merged: 1, trialSamples: 5, ciHalfWidthNs: 60}
+	b = &latencySample{nsPerOpAgg: 200, merged: 1, trialSamples: 5, ciHalfWidthNs: 60}
+	if significant(a, b) {
+		t.Error("significant(a, b) = true for overlapping CIs, want false")
+	}
+}
+
+func TestLatencySampleMerge(t *testing.T) {
+	s := &latencySample{nsPerOpAgg: 100, merged: 1, samples: 10, allsamples: 20, trialSamples: 3, ciHalfWidthNs: 9}
+	o := &latencySample{nsPerOpAgg: 300, merged: 1, samples: 5, allsamples: 10, trialSamples: 7, ciHalfWidthNs: 4}
+	s.merge(o)
+	if s.nsPerOpAgg != 400 || s.merged != 2 {
+		t.Errorf("after merge, nsPerOpAgg = %d, merged = %d, want 400, 2", s.nsPerOpAgg, s.merged)
+	}
+	if s.samples != 15 || s.allsamples != 30 {
+		t.Errorf("after merge, samples = %d, allsamples = %d, want 15, 30", s.samples, s.allsamples)
+	}
+	// o's trialSamples (7) is larger, so its CI half-width supersedes s's.
+	if s.trialSamples != 7 || s.ciHalfWidthNs != 4 {
+		t.Errorf("after merge, trialSamples = %d, ciHalfWidthNs = %d, want 7, 4", s.trialSamples, s.ciHalfWidthNs)
+	}
+	if got, want := s.nsPerOp(), int64(200); got != want {
+		t.Errorf("nsPerOp() after merge = %d, want %d", got, want)
+	}
+}
+
+func TestIndexLatencyAppliesMinSamplesAndMerges(t *testing.T) {
+	old := *minSamples
+	defer func() { *minSamples = old }()
+	*minSamples = 2
+
+	samples := []*latencySample{
+		// file:1 has three records total (meets the cutoff) including two at
+		// the same speedup, which should merge into one.
+		{file: "a.go", line: 1, speedup: 0, nsPerOpAgg: 100, merged: 1},
+		{file: "a.go", line: 1, speedup: 10, nsPerOpAgg: 200, merged: 1},
+		{file: "a.go", line: 1, speedup: 10, nsPerOpAgg: 220, merged: 1},
+		// file:2 has only one record, below the cutoff, and is dropped.
+		{file: "b.go", line: 2, speedup: 0, nsPerOpAgg: 100, merged: 1},
+	}
+	index, locs := indexLatency(samples)
+	if _, ok := index[latencyKey{file: "b.go", line: 2}]; ok {
+		t.Error("indexLatency kept a callsite below -min-samples")
+	}
+	key := latencyKey{file: "a.go", line: 1}
+	i, ok := index[key]
+	if !ok {
+		t.Fatal("indexLatency dropped a callsite that met -min-samples")
+	}
+	if len(i) != 2 {
+		t.Fatalf("indexLatency did not merge same-speedup records: got %d entries, want 2", len(i))
+	}
+	if i[1].merged != 2 || i[1].nsPerOpAgg != 420 {
+		t.Errorf("merged speedup-10 entry = %+v, want merged=2 nsPerOpAgg=420", i[1])
+	}
+	if locs[key] != i[0] {
+		t.Error("locs[key] does not point at the callsite's first (lowest-speedup) sample")
+	}
+}
+
+func TestExtractNull(t *testing.T) {
+	index := map[latencyKey][]*latencySample{
+		{file: "a.go"}: {
+			{file: "a.go", speedup: 0, nsPerOpAgg: 100, merged: 1},
+			{file: "a.go", speedup: 10, nsPerOpAgg: 200, merged: 1},
+		},
+		{file: "b.go"}: {
+			{file: "b.go", speedup: 0, nsPerOpAgg: 300, merged: 1},
+		},
+	}
+	null := extractNull(index)
+	if null.merged != 2 || null.nsPerOpAgg != 400 {
+		t.Errorf("extractNull = %+v, want merged=2 nsPerOpAgg=400", null)
+	}
+	if len(index[latencyKey{file: "a.go"}]) != 1 {
+		t.Error("extractNull did not remove the null sample it merged from a.go's index entry")
+	}
+	if len(index[latencyKey{file: "b.go"}]) != 0 {
+		t.Error("extractNull did not remove the null sample it merged from b.go's index entry")
+	}
+}
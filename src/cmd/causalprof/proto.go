@@ -0,0 +1,143 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "fmt"
+
+// This file decodes the wire format written by runtime/causalprof's
+// profileWriter (see runtime/causalprof/profile.go for the schema). It does
+// not import runtime/causalprof and instead mirrors its Experiment message
+// by hand, the same way internal/profile mirrors runtime/pprof's encoder:
+// cmd tools don't depend on runtime packages as libraries.
+
+const (
+	kindLatency    = 1
+	kindThroughput = 2
+)
+
+const (
+	tagExperimentKind           = 1
+	tagExperimentPc             = 2
+	tagExperimentFunction       = 3
+	tagExperimentFile           = 4
+	tagExperimentLine           = 5
+	tagExperimentSpeedupPercent = 6
+	tagExperimentDelayNs        = 7
+	tagExperimentSamples        = 8
+	tagExperimentAllSamples     = 9
+	tagExperimentNsPerOp        = 10
+	tagExperimentCount          = 11
+	tagExperimentName           = 12
+	tagExperimentEvents         = 13
+	tagExperimentElapsedNs      = 14
+	tagExperimentCIHalfWidthNs  = 15
+	tagExperimentTrialSamples   = 16
+)
+
+// experiment mirrors runtime/causalprof.Experiment.
+type experiment struct {
+	kind           int64
+	pc             uint64
+	function       string
+	file           string
+	line           int64
+	speedupPercent int64
+	delayNs        int64
+	samples        uint64
+	allsamples     uint64
+	nsPerOp        int64
+	count          int64
+	name           string
+	events         int64
+	elapsedNs      int64
+	ciHalfWidthNs  int64
+	trialSamples   int64
+}
+
+func decodeVarint(data []byte) (uint64, []byte, error) {
+	var x uint64
+	var s uint
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		if b < 0x80 {
+			return x | uint64(b)<<s, data[i+1:], nil
+		}
+		x |= uint64(b&0x7f) << s
+		s += 7
+		if s >= 64 {
+			return 0, nil, fmt.Errorf("malformed varint")
+		}
+	}
+	return 0, nil, fmt.Errorf("truncated varint")
+}
+
+func decodeExperiment(data []byte) (*experiment, error) {
+	e := new(experiment)
+	for len(data) > 0 {
+		key, rest, err := decodeVarint(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+		tag, wire := int(key>>3), int(key&7)
+		switch wire {
+		case 0:
+			v, rest, err := decodeVarint(data)
+			if err != nil {
+				return nil, err
+			}
+			data = rest
+			switch tag {
+			case tagExperimentKind:
+				e.kind = int64(v)
+			case tagExperimentPc:
+				e.pc = v
+			case tagExperimentLine:
+				e.line = int64(v)
+			case tagExperimentSpeedupPercent:
+				e.speedupPercent = int64(v)
+			case tagExperimentDelayNs:
+				e.delayNs = int64(v)
+			case tagExperimentSamples:
+				e.samples = v
+			case tagExperimentAllSamples:
+				e.allsamples = v
+			case tagExperimentNsPerOp:
+				e.nsPerOp = int64(v)
+			case tagExperimentCount:
+				e.count = int64(v)
+			case tagExperimentEvents:
+				e.events = int64(v)
+			case tagExperimentElapsedNs:
+				e.elapsedNs = int64(v)
+			case tagExperimentCIHalfWidthNs:
+				e.ciHalfWidthNs = int64(v)
+			case tagExperimentTrialSamples:
+				e.trialSamples = int64(v)
+			}
+		case 2:
+			n, rest, err := decodeVarint(data)
+			if err != nil {
+				return nil, err
+			}
+			if uint64(len(rest)) < n {
+				return nil, fmt.Errorf("truncated field %d", tag)
+			}
+			s := string(rest[:n])
+			data = rest[n:]
+			switch tag {
+			case tagExperimentFunction:
+				e.function = s
+			case tagExperimentFile:
+				e.file = s
+			case tagExperimentName:
+				e.name = s
+			}
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d", wire)
+		}
+	}
+	return e, nil
+}
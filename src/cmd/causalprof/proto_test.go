@@ -0,0 +1,78 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"runtime/causalprof"
+	"testing"
+)
+
+func TestDecodeVarint(t *testing.T) {
+	cases := []struct {
+		data []byte
+		want uint64
+	}{
+		{[]byte{0x00}, 0},
+		{[]byte{0x7f}, 127},
+		{[]byte{0x80, 0x01}, 128},
+		{[]byte{0xac, 0x02}, 300},
+	}
+	for _, c := range cases {
+		got, rest, err := decodeVarint(c.data)
+		if err != nil {
+			t.Errorf("decodeVarint(% x) returned error: %v", c.data, err)
+			continue
+		}
+		if got != c.want || len(rest) != 0 {
+			t.Errorf("decodeVarint(% x) = %d, % x, want %d, []", c.data, got, rest, c.want)
+		}
+	}
+}
+
+func TestDecodeVarintTruncated(t *testing.T) {
+	if _, _, err := decodeVarint([]byte{0x80}); err == nil {
+		t.Error("decodeVarint of a truncated varint returned no error")
+	}
+}
+
+// TestDecodeExperimentRoundTrip checks that decodeExperiment, which hand-
+// mirrors runtime/causalprof's wire format (see the comment atop proto.go),
+// actually agrees with what (*causalprof.Experiment).Marshal produces.
+func TestDecodeExperimentRoundTrip(t *testing.T) {
+	want := &causalprof.Experiment{
+		Kind:           causalprof.KindLatency,
+		Pc:             0xdeadbeef,
+		Function:       "pkg.Fn",
+		File:           "pkg/fn.go",
+		Line:           42,
+		SpeedupPercent: 25,
+		DelayNs:        1000,
+		Samples:        7,
+		AllSamples:     100,
+		NsPerOp:        1234,
+		Count:          3,
+		CIHalfWidthNs:  56,
+		TrialSamples:   4,
+	}
+	got, err := decodeExperiment(want.Marshal())
+	if err != nil {
+		t.Fatalf("decodeExperiment: %v", err)
+	}
+	if got.kind != want.Kind ||
+		got.pc != want.Pc ||
+		got.function != want.Function ||
+		got.file != want.File ||
+		got.line != want.Line ||
+		got.speedupPercent != want.SpeedupPercent ||
+		got.delayNs != want.DelayNs ||
+		got.samples != want.Samples ||
+		got.allsamples != want.AllSamples ||
+		got.nsPerOp != want.NsPerOp ||
+		got.count != want.Count ||
+		got.ciHalfWidthNs != want.CIHalfWidthNs ||
+		got.trialSamples != want.TrialSamples {
+		t.Errorf("decodeExperiment(want.Marshal()) = %+v, want fields matching %+v", got, want)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package causalprof serves a live view of an in-progress causal profile
+// over HTTP, analogous to net/http/pprof.
+//
+// The package is typically only imported for the side effect of registering
+// its HTTP handler.
+// The handled paths all begin with /debug/causalprof/.
+//
+// To use it, link this package into your program:
+//
+//	import _ "net/http/causalprof"
+//
+// If your application is not already running an http server, you need to
+// start one; see net/http/pprof's documentation for an example. Then visit
+// http://localhost:6060/debug/causalprof/ in a browser for an interactive
+// plot of the causal profiling experiments completed so far, or fetch
+// http://localhost:6060/debug/causalprof/stream for a newline-delimited
+// JSON stream of experiment results as they complete. Causal profiling
+// starts the first time any of these paths is requested; see
+// runtime/causalprof.Handler for the full set of endpoints.
+package causalprof
+
+import (
+	"net/http"
+	"runtime/causalprof"
+)
+
+func init() {
+	http.Handle("/debug/causalprof/", http.StripPrefix("/debug/causalprof", causalprof.Handler()))
+}
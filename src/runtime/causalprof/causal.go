@@ -4,17 +4,26 @@
 
 // Package causalprof implements causal profiles as described by
 // https://web.cs.umass.edu/publication/docs/2015/UM-CS-2015-008.pdf
+//
+// Two kinds of progress points are supported: latency progress points
+// (StartProgress/Stop), which measure how long a region of code takes under
+// each virtual speedup, and throughput progress points (Progress), modeled on
+// Coz's COZ_PROGRESS, which measure how often a point in the code is reached
+// per second under each virtual speedup.
 package causalprof
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"runtime"
 	"runtime/pprof"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 var cpu struct {
@@ -23,9 +32,80 @@ var cpu struct {
 	done      chan bool
 }
 
+// Granularity controls how experiment sites are grouped.
+type Granularity int
+
+const (
+	// PCGranularity runs an independent experiment for each sampled PC.
+	// Two PCs on the same source line (common with multiple call sites
+	// per line) are treated as unrelated sites, which can leave each one
+	// under-sampled.
+	PCGranularity Granularity = iota
+	// LineGranularity groups all PCs that map to the same file:line into
+	// a single experiment, and delays every sample whose PC falls on
+	// that line once the experiment is selected.
+	LineGranularity
+	// FunctionGranularity groups all PCs that map to the same function
+	// (the innermost inlined frame) into a single experiment.
+	FunctionGranularity
+)
+
+// Options configures a causal profiling run.
+type Options struct {
+	// Granularity controls how sampled PCs are grouped into experiment
+	// sites. The zero value is PCGranularity.
+	Granularity Granularity
+
+	// Labels, if non-empty, restricts which goroutines are eligible to
+	// have the virtual speedup delay applied to them: only goroutines
+	// running under a pprof label set that is a superset of Labels (see
+	// Do) are delayed. A nil or empty Labels applies the delay globally,
+	// as in earlier versions of this package.
+	//
+	// This lets a production workload run a causal experiment against a
+	// single code path (say, one HTTP route) without slowing down every
+	// other goroutine in the process.
+	Labels map[string]string
+
+	// MinSamples is the minimum number of trials to run at each speedup
+	// before a site's confidence intervals are consulted to decide whether
+	// to keep sampling it. Zero uses defaultMinSamples.
+	MinSamples int
+
+	// CIThreshold stops collecting additional trials for a site once every
+	// speedup's 95% confidence interval half-width (see (*welford).ci95) is
+	// at or below this duration. The maxTrialsPerExperiment hard cap still
+	// applies regardless of whether this threshold is reached. Zero uses
+	// defaultCIThreshold.
+	CIThreshold time.Duration
+}
+
+const defaultMinSamples = 3
+const defaultCIThreshold = 1 * time.Microsecond
+
+// Do calls f with ctx augmented with labels, as pprof.Do does, marking the
+// goroutines that f (and anything it calls) runs on as eligible for causal
+// profiling experiments whose Options.Labels match labels. Do does not
+// itself affect profiling; it only attaches the labels that Options.Labels
+// is matched against.
+func Do(ctx context.Context, labels pprof.LabelSet, f func(context.Context)) {
+	pprof.Do(ctx, labels, f)
+}
+
+// requiredLabels returns a pointer the runtime can compare a goroutine's
+// current labels (from runtime_getProfLabel) against when deciding whether
+// to apply a virtual speedup delay, or nil if opts places no restriction.
+func requiredLabels(opts Options) unsafe.Pointer {
+	if len(opts.Labels) == 0 {
+		return nil
+	}
+	labels := opts.Labels
+	return unsafe.Pointer(&labels)
+}
+
 // Start enables causal profiling. While running, results of causal profiling experiments will
 // be written to w. Start returns an error if causal profiling or CPU profiling is already enabled.
-func Start(w io.Writer) error {
+func Start(w io.Writer, opts Options) error {
 	cpu.Lock()
 	defer cpu.Unlock()
 	if cpu.done == nil {
@@ -39,9 +119,12 @@ func Start(w io.Writer) error {
 	if pprof.IsCPUProfiling() {
 		return fmt.Errorf("cpu profiling already in use")
 	}
+	if err := writeHeader(w); err != nil {
+		return err
+	}
 	atomic.StoreInt32(&cpu.profiling, 1)
 	runtime.SetCPUProfileRate(profilingHz)
-	go profileWriter(w)
+	go profileWriter(w, opts)
 	return nil
 }
 
@@ -68,54 +151,202 @@ func Stop() {
 	cpu.done <- true
 }
 
+// observer, if set (see setObserver), is notified with every Experiment as
+// profileWriter produces it, in addition to it being written to the profile
+// stream. This lets Handler serve live results without decoding its own copy
+// of the wire stream back out of an io.Writer.
+var observer struct {
+	sync.Mutex
+	fn func(*Experiment)
+}
+
+func setObserver(fn func(*Experiment)) {
+	observer.Lock()
+	observer.fn = fn
+	observer.Unlock()
+}
+
+// emit writes e to the profile stream and, if Handler has been used, to the
+// live profile's in-memory state.
+func emit(w io.Writer, e *Experiment) {
+	observer.Lock()
+	fn := observer.fn
+	observer.Unlock()
+	if fn != nil {
+		fn(e)
+	}
+	writeExperiment(w, e)
+}
+
 type experiment struct {
 	trials    int
-	hasNull   bool
 	remaining []int
+	pcs       map[uintptr]bool // sampled PCs that resolved to this site; nil under PCGranularity
+	stats     map[int]*welford // per-speedup (0 is null) latency stats across trials, used to decide when to stop
+}
+
+// numSpeedups is the number of distinct speedups an experiment cycles
+// through each trial: the null (0%) experiment plus one per
+// percentileResolution step up to 100%.
+const numSpeedups = 100/percentileResolution + 1
+
+// converged reports whether every speedup tried so far at expinfo's site has
+// a 95% confidence interval narrow enough, per opts, that running further
+// trials is unlikely to be worthwhile.
+func converged(expinfo *experiment, opts Options) bool {
+	if len(expinfo.stats) < numSpeedups {
+		return false
+	}
+	minSamples := int64(opts.MinSamples)
+	if minSamples == 0 {
+		minSamples = defaultMinSamples
+	}
+	threshold := opts.CIThreshold
+	if threshold == 0 {
+		threshold = defaultCIThreshold
+	}
+	for _, w := range expinfo.stats {
+		if w.n < minSamples || w.ci95() > float64(threshold) {
+			return false
+		}
+	}
+	return true
 }
 
-func profileWriter(w io.Writer) {
-	experiments := make(map[uintptr]*experiment)
+// site identifies an experiment's target at the configured Granularity: a
+// single PC, a source line, or a function.
+type site struct {
+	pc       uintptr
+	file     string
+	line     int
+	function string
+}
+
+// resolveSite maps pc to the site it belongs to under g, along with the
+// frame used to resolve it. Line and function resolution go through
+// runtime.CallersFrames so that inlined frames are attributed to the
+// function that was actually inlined, not the one it was inlined into.
+func resolveSite(pc uintptr, g Granularity) (site, runtime.Frame) {
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	switch g {
+	case LineGranularity:
+		return site{file: frame.File, line: frame.Line}, frame
+	case FunctionGranularity:
+		return site{function: frame.Function}, frame
+	default:
+		return site{pc: pc}, frame
+	}
+}
+
+// install applies delay to every PC belonging to expinfo's site, on
+// goroutines whose pprof labels satisfy labels (see requiredLabels). Under
+// PCGranularity that is always exactly the one PC the experiment was
+// selected for; under Line/FunctionGranularity it is every PC observed so
+// far that maps to the same line or function.
+func install(g Granularity, expinfo *experiment, delay uint64, labels unsafe.Pointer) {
+	if g == PCGranularity {
+		runtime_causalProfileInstall(delay, labels)
+		return
+	}
+	pcs := make([]uintptr, 0, len(expinfo.pcs))
+	for pc := range expinfo.pcs {
+		pcs = append(pcs, pc)
+	}
+	runtime_causalProfileInstallSet(delay, pcs, labels)
+}
+
+func profileWriter(w io.Writer, opts Options) {
+	experiments := make(map[site]*experiment)
 	profMultiple := time.Duration(200)
+	labels := requiredLabels(opts)
 	for {
 		pc := runtime_causalProfileStart()
 		if pc == 0 {
 			<-cpu.done
 			break
 		}
-		expinfo, ok := experiments[pc]
+		key, frame := resolveSite(pc, opts.Granularity)
+		expinfo, ok := experiments[key]
 		if !ok {
 			expinfo = new(experiment)
-			experiments[pc] = expinfo
+			experiments[key] = expinfo
+		}
+		if opts.Granularity != PCGranularity {
+			if expinfo.pcs == nil {
+				expinfo.pcs = make(map[uintptr]bool)
+			}
+			expinfo.pcs[pc] = true
 		}
-		exp := selectExperiment(expinfo)
+		exp := selectExperiment(expinfo, opts)
 		if exp == -1 {
-			runtime_causalProfileInstall(0)
+			install(opts.Granularity, expinfo, 0, labels)
 			continue
 		}
 		delaypersample := uint64(exp) * (percentileResolution * delayPerPercent)
+		speedup := delaypersample / delayPerPercent
 
 		resetProgress()
-		runtime_causalProfileInstall(delaypersample)
+		elapsed := profMultiple * (time.Second / profilingHz)
+		install(opts.Granularity, expinfo, delaypersample, labels)
 		select {
-		case <-time.After(profMultiple * (time.Second / profilingHz)):
+		case <-time.After(elapsed):
 		case <-cpu.done:
-			runtime_causalProfileInstall(0)
+			install(opts.Granularity, expinfo, 0, labels)
 			return
 		}
-		runtime_causalProfileInstall(0)
+		install(opts.Granularity, expinfo, 0, labels)
 		diff, cnt := compareprogress()
-		if diff == -1 {
+		throughput := drainThroughput()
+		if diff == -1 && len(throughput) == 0 {
 			continue
 		}
 		samples, allsamples := runtime_causalProfileSampleStats()
-		_func := runtime.FuncForPC(pc)
-		file, line := _func.FileLine(pc)
-		fmt.Fprintf(w, "# %s %s:%d\n", _func.Name(), file, line)
-		fmt.Fprintf(w, "# speedup %d%%\n", delaypersample/delayPerPercent)
-		fmt.Fprintf(w, "# count %d\n", cnt)
-		fmt.Fprintf(w, "# %dns/op\n", diff)
-		fmt.Fprintf(w, "%#x %d %d %d %d\n", pc, delaypersample/delayPerPercent, diff, samples, allsamples)
+		if diff != -1 {
+			if expinfo.stats == nil {
+				expinfo.stats = make(map[int]*welford)
+			}
+			stat := expinfo.stats[exp]
+			if stat == nil {
+				stat = new(welford)
+				expinfo.stats[exp] = stat
+			}
+			stat.add(float64(diff))
+			ciHalfWidth := stat.ci95()
+			if math.IsInf(ciHalfWidth, 1) {
+				ciHalfWidth = 0
+			}
+			emit(w, &Experiment{
+				Kind:           KindLatency,
+				Pc:             uint64(pc),
+				Function:       frame.Function,
+				File:           frame.File,
+				Line:           int64(frame.Line),
+				SpeedupPercent: int64(speedup),
+				DelayNs:        int64(delaypersample),
+				Samples:        samples,
+				AllSamples:     allsamples,
+				NsPerOp:        int64(stat.mean),
+				Count:          int64(cnt),
+				CIHalfWidthNs:  int64(ciHalfWidth),
+				TrialSamples:   stat.n,
+			})
+		}
+		for name, events := range throughput {
+			emit(w, &Experiment{
+				Kind:           KindThroughput,
+				Pc:             uint64(pc),
+				Function:       frame.Function,
+				File:           frame.File,
+				Line:           int64(frame.Line),
+				SpeedupPercent: int64(speedup),
+				DelayNs:        int64(delaypersample),
+				Samples:        samples,
+				AllSamples:     allsamples,
+				Name:           name,
+				Events:         events,
+				ElapsedNs:      int64(elapsed),
+			})
+		}
 		// allow system state to return to normal
 		if progressPerExperiment > cnt {
 			if progressPerExperiment > 2*cnt {
@@ -130,29 +361,37 @@ func profileWriter(w io.Writer) {
 	}
 }
 
-func selectExperiment(expinfo *experiment) int {
-	if expinfo.hasNull && len(expinfo.remaining) == 0 {
-		if expinfo.trials == maxTrialsPerExperiment {
+// selectExperiment returns the next speedup (0 for null, through
+// 100/percentileResolution for the 100% speedup) to try at expinfo's site, or
+// -1 if enough trials have run: either every speedup's confidence interval
+// has converged (see converged) or the maxTrialsPerExperiment hard cap has
+// been hit.
+func selectExperiment(expinfo *experiment, opts Options) int {
+	if len(expinfo.remaining) == 0 {
+		if expinfo.trials > 0 && (expinfo.trials >= maxTrialsPerExperiment || converged(expinfo, opts)) {
 			return -1
 		}
 		expinfo.trials++
-		expinfo.remaining = rand.Perm(100 / percentileResolution)
+		expinfo.remaining = rand.Perm(numSpeedups)
 	}
-	if !expinfo.hasNull && (len(expinfo.remaining) == 0 || rand.Intn(2) == 1) {
-		expinfo.hasNull = true
-		return 0
-	}
-	exp := expinfo.remaining[0] + 1
+	exp := expinfo.remaining[0]
 	expinfo.remaining = expinfo.remaining[1:]
 	return exp
 }
 
 func runtime_causalProfileStart() uintptr
-func runtime_causalProfileInstall(delay uint64)
+func runtime_causalProfileInstall(delay uint64, labels unsafe.Pointer)
+func runtime_causalProfileInstallSet(delay uint64, pcs []uintptr, labels unsafe.Pointer)
 func runtime_causalProfileGetDelay() uint64
 func runtime_causalProfileStopProf()
 func runtime_causalProfileSampleStats() (uint64, uint64)
 
+// runtime_getProfLabel returns the calling goroutine's current pprof label
+// set, as a *map[string]string (see runtime/pprof's labelMap), or nil if it
+// has none. The runtime uses it to decide whether a goroutine's labels are a
+// superset of the labels passed to runtime_causalProfileInstall(Set).
+func runtime_getProfLabel() unsafe.Pointer
+
 var progress int
 var progresstime time.Duration
 var experimentNum uint64
@@ -164,27 +403,71 @@ func resetProgress() {
 	progress = 0
 	progresstime = 0
 	atomic.AddUint64(&experimentNum, 1)
+
+	throughput.Lock()
+	throughput.counts = nil
+	throughput.Unlock()
+}
+
+// throughput holds the per-callsite counters incremented by Progress. It is
+// reset at the start of every experiment and drained at the end of one by
+// drainThroughput.
+var throughput struct {
+	sync.Mutex
+	counts map[string]int64
+}
+
+// Progress records a single throughput progress point, modeled on Coz's
+// COZ_PROGRESS. Unlike StartProgress/Stop, which bound a region of code whose
+// latency is under study, Progress is a single call marking the completion of
+// one unit of work (for example, one request served). Call it each time name
+// is reached; profileWriter reports the resulting rate (events/sec) for name
+// at each virtual speedup tried by the current experiment.
+func Progress(name string) {
+	if atomic.LoadInt32(&cpu.profiling) == 0 {
+		return
+	}
+	throughput.Lock()
+	if throughput.counts == nil {
+		throughput.counts = make(map[string]int64)
+	}
+	throughput.counts[name]++
+	throughput.Unlock()
+}
+
+// drainThroughput returns the counts accumulated by Progress since the last
+// reset and clears them for the next experiment.
+func drainThroughput() map[string]int64 {
+	throughput.Lock()
+	counts := throughput.counts
+	throughput.counts = nil
+	throughput.Unlock()
+	return counts
 }
 
-type Progress struct {
+// LatencyProgress marks a region of code whose latency is under study by the
+// current experiment. It is obtained from StartProgress and ended with Stop.
+type LatencyProgress struct {
 	startTime     time.Time
 	startDelay    uint64
 	experimentNum uint64
 }
 
-func StartProgress() Progress {
+// StartProgress begins a latency progress point. The returned LatencyProgress
+// must be stopped with Stop to record its duration.
+func StartProgress() LatencyProgress {
 	profiling := atomic.LoadInt32(&cpu.profiling)
 	if profiling == 0 {
-		return Progress{}
+		return LatencyProgress{}
 	}
-	return Progress{
+	return LatencyProgress{
 		startTime:     time.Now(),
 		startDelay:    runtime_causalProfileGetDelay(),
 		experimentNum: atomic.LoadUint64(&experimentNum),
 	}
 }
 
-func (p *Progress) Stop() {
+func (p *LatencyProgress) Stop() {
 	if p.startTime.IsZero() {
 		return
 	}
@@ -0,0 +1,380 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package causalprof
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// liveProf holds the state backing Handler: every latency and throughput
+// experiment recorded since the live profile was started, keyed so that
+// later experiments at the same site and speedup supersede earlier ones,
+// plus the set of subscribers streaming results from /stream.
+var liveProf struct {
+	sync.Mutex
+	started    bool
+	latency    map[site]map[int64]*Experiment   // site -> speedup percent -> latest result
+	throughput map[string]map[int64]*Experiment // progress-point name -> speedup percent -> latest result
+	wanted     map[string]bool                  // throughput names added via POST /progress; nil means track all
+	subs       map[chan []byte]bool
+}
+
+// ensureStarted starts causal profiling the first time it is called, writing
+// to io.Discard and registering recordLive as the observer so liveProf is
+// kept up to date instead. It also notices if profiling has stopped since
+// (cpu.profiling is package-wide, so a Stop call from outside this package
+// stops it out from under Handler too) and restarts it, rather than serving
+// a frozen snapshot forever once whatever called Stop is done. If Start
+// fails (for example because CPU profiling is already in use elsewhere),
+// started is left false so the next call tries again, rather than wedging
+// the live view for good once whatever was holding CPU profiling has gone
+// away.
+func ensureStarted() error {
+	liveProf.Lock()
+	defer liveProf.Unlock()
+	if liveProf.started && atomic.LoadInt32(&cpu.profiling) != 0 {
+		return nil
+	}
+	setObserver(recordLive)
+	if err := Start(io.Discard, Options{}); err != nil {
+		return err
+	}
+	liveProf.started = true
+	return nil
+}
+
+// recordLive is installed as the package's observer once Handler has been
+// used; it updates liveProf's accumulated state and fans e out to any
+// /stream subscribers.
+func recordLive(e *Experiment) {
+	liveProf.Lock()
+	switch e.Kind {
+	case KindLatency:
+		key := site{pc: uintptr(e.Pc), file: e.File, line: int(e.Line), function: e.Function}
+		if liveProf.latency == nil {
+			liveProf.latency = make(map[site]map[int64]*Experiment)
+		}
+		bySpeedup := liveProf.latency[key]
+		if bySpeedup == nil {
+			bySpeedup = make(map[int64]*Experiment)
+			liveProf.latency[key] = bySpeedup
+		}
+		bySpeedup[e.SpeedupPercent] = e
+	case KindThroughput:
+		if liveProf.wanted != nil && !liveProf.wanted[e.Name] {
+			liveProf.Unlock()
+			return
+		}
+		if liveProf.throughput == nil {
+			liveProf.throughput = make(map[string]map[int64]*Experiment)
+		}
+		bySpeedup := liveProf.throughput[e.Name]
+		if bySpeedup == nil {
+			bySpeedup = make(map[int64]*Experiment)
+			liveProf.throughput[e.Name] = bySpeedup
+		}
+		bySpeedup[e.SpeedupPercent] = e
+	}
+	// Snapshot the subscriber set into a slice before unlocking: serveStream
+	// adds and removes entries from liveProf.subs under the same lock, and
+	// ranging over the map itself here would race with that.
+	subs := make([]chan []byte, 0, len(liveProf.subs))
+	for ch := range liveProf.subs {
+		subs = append(subs, ch)
+	}
+	liveProf.Unlock()
+
+	if len(subs) == 0 {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	for _, ch := range subs {
+		select {
+		case ch <- data:
+		default: // a slow subscriber misses a record rather than blocking the profiler
+		}
+	}
+}
+
+// Handler returns an http.Handler serving a live view of an in-progress
+// causal profiling run: an interactive plot of every callsite's virtual
+// speedup vs. program speedup at its root, a newline-delimited JSON stream
+// of experiments as they complete at /stream, the same data as a single JSON
+// snapshot at /plot.json, and a /progress endpoint to add or remove the
+// throughput progress-point names it tracks. /plot.json accepts a ?pkg=
+// query parameter that restricts latency results to callsites whose function
+// name has that prefix; the root page's package-prefix box sets it. The root
+// itself ignores query parameters, and progress-point series are not filtered.
+//
+// Handler starts causal profiling, as Start would, the first time it is
+// invoked, so mounting it is enough to make causal profiling data available
+// over HTTP without stopping the process to collect and post-process a
+// file. It returns an error (as plain text, with an appropriate status
+// code) if causal profiling could not be started, for example because CPU
+// profiling is already in use.
+//
+// It is typically mounted under /debug/causalprof/ by net/http/causalprof,
+// the same way net/http/pprof mounts runtime/pprof's profiles.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", indexHTML)
+	mux.HandleFunc("/stream", serveStream)
+	mux.HandleFunc("/plot.json", servePlot)
+	mux.HandleFunc("/progress", serveProgress)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := ensureStarted(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// serveStream streams a newline-delimited JSON Experiment per completed
+// experiment, for as long as the request stays open.
+func serveStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan []byte, 64)
+	liveProf.Lock()
+	if liveProf.subs == nil {
+		liveProf.subs = make(map[chan []byte]bool)
+	}
+	liveProf.subs[ch] = true
+	liveProf.Unlock()
+	defer func() {
+		liveProf.Lock()
+		delete(liveProf.subs, ch)
+		liveProf.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	for {
+		select {
+		case data := <-ch:
+			if _, err := w.Write(data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// plotPoint is a single (virtual speedup, program speedup) pair, in the
+// format expected by the causal-profile plot viewer (see cmd/causalprof's
+// plotPoint): Min and Max bound the 95% confidence interval when one is
+// available, and otherwise equal Y.
+type plotPoint struct {
+	X   float64 `json:"x"`
+	Y   float64 `json:"y"`
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// plotSeries is one line's worth of experiments: one per callsite or
+// progress point.
+type plotSeries struct {
+	Name   string      `json:"name"`
+	Points []plotPoint `json:"points"`
+}
+
+// servePlot writes the current snapshot of accumulated experiments as a JSON
+// array of plotSeries, optionally restricted to callsites whose function
+// name has the ?pkg= prefix.
+func servePlot(w http.ResponseWriter, r *http.Request) {
+	series := plotSnapshot(r.URL.Query().Get("pkg"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+func plotSnapshot(pkgPrefix string) []plotSeries {
+	liveProf.Lock()
+	defer liveProf.Unlock()
+
+	var series []plotSeries
+	for key, bySpeedup := range liveProf.latency {
+		if pkgPrefix != "" && !strings.HasPrefix(key.function, pkgPrefix) {
+			continue
+		}
+		null := bySpeedup[0]
+		if null == nil || null.NsPerOp == 0 {
+			continue
+		}
+		name := key.function
+		if name == "" {
+			name = fmt.Sprintf("%#x", key.pc)
+		} else {
+			name = fmt.Sprintf("%s (%s:%d)", name, key.file, key.line)
+		}
+		s := plotSeries{Name: name}
+		for _, e := range bySpeedup {
+			if e.SpeedupPercent == 0 {
+				continue
+			}
+			y := float64(e.NsPerOp-null.NsPerOp) / float64(null.NsPerOp) * 100
+			ymin, ymax := y, y
+			if e.TrialSamples >= 2 {
+				ymin = float64(e.NsPerOp-e.CIHalfWidthNs-null.NsPerOp) / float64(null.NsPerOp) * 100
+				ymax = float64(e.NsPerOp+e.CIHalfWidthNs-null.NsPerOp) / float64(null.NsPerOp) * 100
+			}
+			s.Points = append(s.Points, plotPoint{X: float64(e.SpeedupPercent), Y: y, Min: ymin, Max: ymax})
+		}
+		sort.Slice(s.Points, func(i, j int) bool { return s.Points[i].X < s.Points[j].X })
+		series = append(series, s)
+	}
+	for name, bySpeedup := range liveProf.throughput {
+		null := bySpeedup[0]
+		if null == nil || null.ElapsedNs == 0 || null.Events == 0 {
+			continue
+		}
+		nullRate := float64(null.Events) / (float64(null.ElapsedNs) / 1e9)
+		s := plotSeries{Name: "progress: " + name}
+		for _, e := range bySpeedup {
+			if e.SpeedupPercent == 0 {
+				continue
+			}
+			rate := float64(e.Events) / (float64(e.ElapsedNs) / 1e9)
+			y := (rate - nullRate) / nullRate * 100
+			s.Points = append(s.Points, plotPoint{X: float64(e.SpeedupPercent), Y: y, Min: y, Max: y})
+		}
+		sort.Slice(s.Points, func(i, j int) bool { return s.Points[i].X < s.Points[j].X })
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Name < series[j].Name })
+	return series
+}
+
+// serveProgress adds (POST) or removes (DELETE) a throughput progress-point
+// name from the set the live profile tracks. Before the first POST, every
+// progress point is tracked; adding one explicitly restricts tracking to the
+// named progress points, which bounds memory use on a long-running server
+// whose workload calls Progress with many distinct names, most of which an
+// operator isn't currently looking at. Before the first POST, a DELETE only
+// discards the name's accumulated results: the name is still tracked and
+// reappears with its next experiment.
+func serveProgress(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing name parameter", http.StatusBadRequest)
+		return
+	}
+	liveProf.Lock()
+	defer liveProf.Unlock()
+	switch r.Method {
+	case http.MethodPost:
+		if liveProf.wanted == nil {
+			liveProf.wanted = make(map[string]bool)
+		}
+		liveProf.wanted[name] = true
+	case http.MethodDelete:
+		delete(liveProf.wanted, name)
+		delete(liveProf.throughput, name)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func indexHTML(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, indexPage)
+}
+
+const indexPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>causal profile</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+svg { border: 1px solid #ccc; margin: 0 1em 1em 0; }
+div.plots { display: flex; flex-wrap: wrap; }
+</style>
+</head>
+<body>
+<h1>causal profile</h1>
+<p>
+  package prefix:
+  <input id="pkg" type="text" size="40" onchange="refresh()">
+</p>
+<div class="plots" id="plots"></div>
+<script>
+function refresh() {
+  var pkg = document.getElementById("pkg").value;
+  fetch("plot.json?pkg=" + encodeURIComponent(pkg))
+    .then(function(r) { return r.json(); })
+    .then(render);
+}
+function render(series) {
+  var container = document.getElementById("plots");
+  container.innerHTML = "";
+  (series || []).forEach(function(s) { container.appendChild(renderSeries(s)); });
+  if (!series || series.length === 0) {
+    container.textContent = "no experiments completed yet";
+  }
+}
+function renderSeries(s) {
+  var w = 360, h = 220, pad = 32;
+  var svgns = "http://www.w3.org/2000/svg";
+  var svg = document.createElementNS(svgns, "svg");
+  svg.setAttribute("width", w);
+  svg.setAttribute("height", h);
+  var title = document.createElementNS(svgns, "text");
+  title.setAttribute("x", pad);
+  title.setAttribute("y", 16);
+  title.setAttribute("font-size", "11");
+  title.textContent = s.name;
+  svg.appendChild(title);
+  var xmax = 100, ymax = 1;
+  s.points.forEach(function(p) {
+    xmax = Math.max(xmax, p.x);
+    ymax = Math.max(ymax, Math.abs(p.min), Math.abs(p.max));
+  });
+  function sx(x) { return pad + (x / xmax) * (w - 2 * pad); }
+  function sy(y) { return h / 2 - (y / ymax) * (h / 2 - pad); }
+  var axis = document.createElementNS(svgns, "line");
+  axis.setAttribute("x1", pad); axis.setAttribute("x2", w - pad);
+  axis.setAttribute("y1", h / 2); axis.setAttribute("y2", h / 2);
+  axis.setAttribute("stroke", "#999");
+  svg.appendChild(axis);
+  s.points.forEach(function(p) {
+    var bar = document.createElementNS(svgns, "line");
+    bar.setAttribute("x1", sx(p.x)); bar.setAttribute("x2", sx(p.x));
+    bar.setAttribute("y1", sy(p.min)); bar.setAttribute("y2", sy(p.max));
+    bar.setAttribute("stroke", "#aac");
+    svg.appendChild(bar);
+    var c = document.createElementNS(svgns, "circle");
+    c.setAttribute("cx", sx(p.x)); c.setAttribute("cy", sy(p.y));
+    c.setAttribute("r", 3);
+    c.setAttribute("fill", "#36c");
+    svg.appendChild(c);
+  });
+  var div = document.createElement("div");
+  div.appendChild(svg);
+  return div;
+}
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
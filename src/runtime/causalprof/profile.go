@@ -0,0 +1,131 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package causalprof
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Output format.
+//
+// A causal profile written by Start is a versioned, self-describing stream:
+// a 5 byte header (magic "cprf" followed by a version byte) followed by a
+// sequence of length-prefixed Experiment records, one per completed
+// experiment, in the wire format described by the tagExperiment_ constants
+// below. This replaces the line-oriented, ad-hoc text format previously
+// written directly to w; cmd/causalprof understands both.
+//
+// Each record's fields are resolved to a function/file/line here, at write
+// time, rather than left as a bare pc for the reader to symbolize against a
+// binary, since the profiling process already has everything needed to do
+// so. The Experiment type also doubles as a JSON schema (see its struct
+// tags): callers that want a human-readable or tool-friendly fallback can
+// json.Marshal a decoded Experiment instead of working with the protobuf
+// wire form.
+const (
+	profileMagic   = "cprf"
+	profileVersion = 1
+)
+
+// Experiment kinds.
+const (
+	KindLatency    = 1
+	KindThroughput = 2
+)
+
+// Wire tags for the Experiment message.
+const (
+	tagExperiment_Kind           = 1  // varint, KindLatency or KindThroughput
+	tagExperiment_Pc             = 2  // varint
+	tagExperiment_Function       = 3  // string
+	tagExperiment_File           = 4  // string
+	tagExperiment_Line           = 5  // varint
+	tagExperiment_SpeedupPercent = 6  // varint
+	tagExperiment_DelayNs        = 7  // varint
+	tagExperiment_Samples        = 8  // varint
+	tagExperiment_AllSamples     = 9  // varint
+	tagExperiment_NsPerOp        = 10 // varint, latency experiments only
+	tagExperiment_Count          = 11 // varint, latency experiments only
+	tagExperiment_Name           = 12 // string, throughput experiments only
+	tagExperiment_Events         = 13 // varint, throughput experiments only
+	tagExperiment_ElapsedNs      = 14 // varint, throughput experiments only
+	tagExperiment_CIHalfWidthNs  = 15 // varint, latency experiments only
+	tagExperiment_TrialSamples   = 16 // varint, latency experiments only
+)
+
+// Experiment is the result of a single causal profiling experiment: holding
+// a virtual speedup at a given callsite constant for a while and observing
+// its effect on either a latency progress point (NsPerOp) or a throughput
+// progress point (Events/ElapsedNs).
+type Experiment struct {
+	Kind           int64  `json:"kind"`
+	Pc             uint64 `json:"pc"`
+	Function       string `json:"function"`
+	File           string `json:"file"`
+	Line           int64  `json:"line"`
+	SpeedupPercent int64  `json:"speedupPercent"`
+	DelayNs        int64  `json:"delayNs"`
+	Samples        uint64 `json:"samples"`
+	AllSamples     uint64 `json:"allSamples"`
+
+	NsPerOp int64 `json:"nsPerOp,omitempty"` // latency experiments only
+	Count   int64 `json:"count,omitempty"`   // latency experiments only
+
+	// CIHalfWidthNs and TrialSamples describe the 95% confidence interval of
+	// NsPerOp accumulated across every trial run at this speedup so far
+	// (see runtime/causalprof's welford type): the mean is NsPerOp ± the
+	// half-width, computed from TrialSamples observations.
+	CIHalfWidthNs int64 `json:"ciHalfWidthNs,omitempty"` // latency experiments only
+	TrialSamples  int64 `json:"trialSamples,omitempty"`  // latency experiments only
+
+	Name      string `json:"name,omitempty"`      // throughput experiments only
+	Events    int64  `json:"events,omitempty"`    // throughput experiments only
+	ElapsedNs int64  `json:"elapsedNs,omitempty"` // throughput experiments only
+}
+
+func (e *Experiment) encode(b *protobuf) {
+	b.int64(tagExperiment_Kind, e.Kind)
+	b.uint64(tagExperiment_Pc, e.Pc)
+	b.stringOpt(tagExperiment_Function, e.Function)
+	b.stringOpt(tagExperiment_File, e.File)
+	b.int64Opt(tagExperiment_Line, e.Line)
+	b.int64(tagExperiment_SpeedupPercent, e.SpeedupPercent)
+	b.int64Opt(tagExperiment_DelayNs, e.DelayNs)
+	b.uint64(tagExperiment_Samples, e.Samples)
+	b.uint64(tagExperiment_AllSamples, e.AllSamples)
+	b.int64Opt(tagExperiment_NsPerOp, e.NsPerOp)
+	b.int64Opt(tagExperiment_Count, e.Count)
+	b.int64Opt(tagExperiment_CIHalfWidthNs, e.CIHalfWidthNs)
+	b.int64Opt(tagExperiment_TrialSamples, e.TrialSamples)
+	b.stringOpt(tagExperiment_Name, e.Name)
+	b.int64Opt(tagExperiment_Events, e.Events)
+	b.int64Opt(tagExperiment_ElapsedNs, e.ElapsedNs)
+}
+
+// Marshal encodes e in the causal profile wire format.
+func (e *Experiment) Marshal() []byte {
+	var b protobuf
+	e.encode(&b)
+	return b.data
+}
+
+// writeHeader writes the stream's magic and version to w.
+func writeHeader(w io.Writer) error {
+	_, err := w.Write(append([]byte(profileMagic), profileVersion))
+	return err
+}
+
+// writeExperiment appends e to w as a length-prefixed record.
+func writeExperiment(w io.Writer, e *Experiment) error {
+	data := e.Marshal()
+	var hdr [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(hdr[:], uint64(len(data)))
+	if _, err := w.Write(hdr[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
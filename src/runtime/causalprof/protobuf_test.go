@@ -0,0 +1,69 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package causalprof
+
+import "testing"
+
+func TestProtobufVarint(t *testing.T) {
+	cases := []struct {
+		x    uint64
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{300, []byte{0xac, 0x02}},
+	}
+	for _, c := range cases {
+		var b protobuf
+		b.varint(c.x)
+		if string(b.data) != string(c.want) {
+			t.Errorf("varint(%d) = % x, want % x", c.x, b.data, c.want)
+		}
+	}
+}
+
+func TestProtobufOptFieldsOmitZero(t *testing.T) {
+	var b protobuf
+	b.int64Opt(1, 0)
+	b.stringOpt(2, "")
+	if len(b.data) != 0 {
+		t.Errorf("int64Opt/stringOpt of zero values wrote %d bytes, want 0", len(b.data))
+	}
+
+	b.int64Opt(1, 5)
+	b.stringOpt(2, "x")
+	if len(b.data) == 0 {
+		t.Errorf("int64Opt/stringOpt of non-zero values wrote no bytes")
+	}
+}
+
+func TestExperimentMarshalKindFirst(t *testing.T) {
+	e := &Experiment{
+		Kind:           KindLatency,
+		Pc:             0xdeadbeef,
+		Function:       "pkg.Fn",
+		File:           "pkg/fn.go",
+		Line:           42,
+		SpeedupPercent: 25,
+		DelayNs:        1000,
+		Samples:        7,
+		AllSamples:     100,
+		NsPerOp:        1234,
+		Count:          3,
+		CIHalfWidthNs:  56,
+		TrialSamples:   4,
+	}
+	data := e.Marshal()
+	if len(data) == 0 {
+		t.Fatal("Marshal produced no bytes")
+	}
+	// encode writes Kind unconditionally and before any other field, so the
+	// first key byte must carry Kind's tag.
+	if data[0]>>3 != tagExperiment_Kind {
+		t.Errorf("first field tag = %d, want %d (Kind is always first and always emitted)", data[0]>>3, tagExperiment_Kind)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package causalprof
+
+import "math"
+
+// welford tracks the running mean and variance of a sequence of float64
+// observations using Welford's online algorithm (Welford, 1962), so a
+// site's statistics can be updated trial by trial without retaining every
+// sample observed so far.
+type welford struct {
+	n    int64
+	mean float64
+	m2   float64
+}
+
+// add folds x into the running mean and variance.
+func (w *welford) add(x float64) {
+	w.n++
+	delta := x - w.mean
+	w.mean += delta / float64(w.n)
+	w.m2 += delta * (x - w.mean)
+}
+
+// variance returns the sample variance of the observations added so far, or
+// 0 if fewer than two have been added.
+func (w *welford) variance() float64 {
+	if w.n < 2 {
+		return 0
+	}
+	return w.m2 / float64(w.n-1)
+}
+
+// ci95 returns the half-width of a 95% confidence interval for the mean, using
+// the Student's t distribution rather than a normal approximation since
+// causal profiling trials are expensive and the sample counts involved are
+// often small. It returns +Inf until at least two observations have been
+// added, so that code comparing ci95 against a threshold never mistakes a
+// lack of data for a converged estimate.
+func (w *welford) ci95() float64 {
+	if w.n < 2 {
+		return math.Inf(1)
+	}
+	stderr := math.Sqrt(w.variance() / float64(w.n))
+	return tCrit95(w.n-1) * stderr
+}
+
+// tCrit95 returns the two-tailed 95% critical value of Student's t
+// distribution with df degrees of freedom. Values for df in [1, 30] come
+// from the standard t-table; above that the distribution is close enough to
+// normal that 1.96 (the z critical value) is used instead.
+func tCrit95(df int64) float64 {
+	if df <= 0 || df >= int64(len(tTable95)) {
+		return 1.96
+	}
+	return tTable95[df]
+}
+
+// tTable95[df] is the two-tailed 95% critical value of Student's t
+// distribution with df degrees of freedom, for df in [1, 30]. Index 0 is
+// unused: ci95 never calls tCrit95 with df 0, since it requires n >= 2.
+var tTable95 = [...]float64{
+	0:  0,
+	1:  12.706,
+	2:  4.303,
+	3:  3.182,
+	4:  2.776,
+	5:  2.571,
+	6:  2.447,
+	7:  2.365,
+	8:  2.306,
+	9:  2.262,
+	10: 2.228,
+	11: 2.201,
+	12: 2.179,
+	13: 2.160,
+	14: 2.145,
+	15: 2.131,
+	16: 2.120,
+	17: 2.110,
+	18: 2.101,
+	19: 2.093,
+	20: 2.086,
+	21: 2.080,
+	22: 2.074,
+	23: 2.069,
+	24: 2.064,
+	25: 2.060,
+	26: 2.056,
+	27: 2.052,
+	28: 2.048,
+	29: 2.045,
+	30: 2.042,
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package causalprof
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWelfordMeanAndVariance(t *testing.T) {
+	var w welford
+	for _, x := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		w.add(x)
+	}
+	if w.n != 8 {
+		t.Fatalf("n = %d, want 8", w.n)
+	}
+	if got, want := w.mean, 5.0; math.Abs(got-want) > 1e-9 {
+		t.Errorf("mean = %v, want %v", got, want)
+	}
+	if got, want := w.variance(), 32.0/7.0; math.Abs(got-want) > 1e-9 {
+		t.Errorf("variance = %v, want %v", got, want)
+	}
+}
+
+func TestWelfordVarianceNeedsTwoSamples(t *testing.T) {
+	var w welford
+	if got := w.variance(); got != 0 {
+		t.Errorf("variance of an empty welford = %v, want 0", got)
+	}
+	w.add(3)
+	if got := w.variance(); got != 0 {
+		t.Errorf("variance of a single-sample welford = %v, want 0", got)
+	}
+}
+
+func TestWelfordCI95NeedsTwoSamples(t *testing.T) {
+	var w welford
+	if got := w.ci95(); !math.IsInf(got, 1) {
+		t.Errorf("ci95 of an empty welford = %v, want +Inf", got)
+	}
+	w.add(3)
+	if got := w.ci95(); !math.IsInf(got, 1) {
+		t.Errorf("ci95 of a single-sample welford = %v, want +Inf", got)
+	}
+	w.add(5)
+	if got := w.ci95(); math.IsInf(got, 1) || got <= 0 {
+		t.Errorf("ci95 after two samples = %v, want a finite positive half-width", got)
+	}
+}
+
+func TestTCrit95(t *testing.T) {
+	if got := tCrit95(1); got != 12.706 {
+		t.Errorf("tCrit95(1) = %v, want 12.706", got)
+	}
+	if got := tCrit95(30); got != 2.042 {
+		t.Errorf("tCrit95(30) = %v, want 2.042", got)
+	}
+	// Beyond the table, and for non-positive df, fall back to the z
+	// critical value.
+	if got := tCrit95(31); got != 1.96 {
+		t.Errorf("tCrit95(31) = %v, want 1.96", got)
+	}
+	if got := tCrit95(0); got != 1.96 {
+		t.Errorf("tCrit95(0) = %v, want 1.96", got)
+	}
+}